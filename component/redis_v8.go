@@ -0,0 +1,80 @@
+package component
+
+import (
+	"github.com/cosiner/gohper/defval"
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/zerver"
+	goredis "github.com/go-redis/redis/v8"
+)
+
+// COMP_REDIS_V8 names the RedisV8 component, the go-redis/v8 counterpart of
+// COMP_REDIS, looked up via zerver.Enviroment.Component.
+const COMP_REDIS_V8 = "COMP_REDIS_V8"
+
+// RedisV8 exposes a github.com/go-redis/redis/v8 UniversalClient, built as a
+// standalone client, a Sentinel-monitored failover client, or a Cluster
+// client depending on which fields are configured:
+//
+//   - ClusterAddrs set: Cluster
+//   - MasterName and SentinelAddrs set: Sentinel failover group
+//   - otherwise: standalone, using Addr
+//
+// Callers that only need the client, not the topology it was built from,
+// can treat any RedisV8 the same way via Client().
+type RedisV8 struct {
+	// Addr is the standalone server address, used when neither ClusterAddrs
+	// nor MasterName/SentinelAddrs are set. Default "127.0.0.1:6379".
+	Addr string
+	// MasterName and SentinelAddrs select a Sentinel-monitored failover
+	// group; both must be set.
+	MasterName    string
+	SentinelAddrs []string
+	// ClusterAddrs selects a Cluster client, and takes precedence over
+	// MasterName/SentinelAddrs if both are set.
+	ClusterAddrs []string
+
+	DB       int
+	Password string
+
+	client goredis.UniversalClient
+}
+
+func (r *RedisV8) Init(zerver.Enviroment) error {
+	switch {
+	case len(r.ClusterAddrs) > 0:
+		r.client = goredis.NewClusterClient(&goredis.ClusterOptions{
+			Addrs:    r.ClusterAddrs,
+			Password: r.Password,
+		})
+	case r.MasterName != "" && len(r.SentinelAddrs) > 0:
+		r.client = goredis.NewFailoverClient(&goredis.FailoverOptions{
+			MasterName:    r.MasterName,
+			SentinelAddrs: r.SentinelAddrs,
+			DB:            r.DB,
+			Password:      r.Password,
+		})
+	case r.MasterName != "" || len(r.SentinelAddrs) > 0:
+		return errors.Err("RedisV8: MasterName and SentinelAddrs must both be set to use Sentinel")
+	default:
+		defval.String(&r.Addr, "127.0.0.1:6379")
+		r.client = goredis.NewClient(&goredis.Options{
+			Addr:     r.Addr,
+			DB:       r.DB,
+			Password: r.Password,
+		})
+	}
+	return nil
+}
+
+func (r *RedisV8) Destroy() {
+	if r.client != nil {
+		r.client.Close()
+		r.client = nil
+	}
+}
+
+// Client returns the underlying UniversalClient, transparent to whichever
+// topology this component was configured for.
+func (r *RedisV8) Client() goredis.UniversalClient {
+	return r.client
+}
@@ -1,115 +1,636 @@
 package filter
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/cosiner/gohper/defval"
 	"github.com/cosiner/gohper/errors"
 	"github.com/cosiner/zerver"
 	"github.com/cosiner/zerver/component"
-	"github.com/garyburd/redigo/redis"
+	goredis "github.com/go-redis/redis/v8"
 )
 
 const (
-	ErrRequestIDExist = errors.Err("Request id already exist")
+	ErrRequestIDExist   = errors.Err("Request id already exist")
+	ErrTooManyInFlight  = errors.Err("too many in-flight request ids")
+	defaultJanitorSweep = 30 * time.Second
+
+	// AttrRequestID is the request attribute key RequestId stashes the
+	// resolved id under, so downstream handlers and logging can correlate a
+	// request without re-reading or re-generating the header.
+	AttrRequestID = "filter.RequestID"
 )
 
 type (
-	// RequestId is a simple filter prevent application/user from overlap request
-	// the request id is generated by client itself or other server components.
+	// IDGenerator mints a new request id when a client doesn't send one.
+	IDGenerator func() string
+
+	// RequestId implements the Idempotency-Key pattern: a non-GET request
+	// carrying an Idempotency-Key header is only ever executed once, and
+	// every later request with the same key from the same client replays
+	// the response captured the first time instead of re-running it.
 	RequestId struct {
 		Store         IDStore
 		HeaderName    string
 		PassingOnNoId bool
-		Error         string
-		ErrorOverlap  string
-		logger        zerver.Logger
+		// GenerateIfMissing mints an id via IDGenerator when the client
+		// didn't send one, instead of relying on PassingOnNoId/Error alone.
+		// A minted id runs through Store the same as a client-provided one,
+		// and is additionally stashed on the request under AttrRequestID and
+		// echoed back on ResponseHeaderName, so downstream logging and the
+		// client can both correlate the request by it.
+		GenerateIfMissing  bool
+		IDGenerator        IDGenerator
+		ResponseHeaderName string
+		// TTL bounds how long a key is reserved for: it covers both the
+		// crash window between Begin and Complete/Fail (a dead owner's
+		// reservation is eventually released instead of blocking the key
+		// forever) and how long a completed response stays replayable.
+		TTL          time.Duration
+		Error        string
+		ErrorOverlap string
+		// ErrorBusy is sent when Store rejects a key with ErrTooManyInFlight,
+		// i.e. the in-flight cap meant to protect the server is itself the
+		// reason the request can't proceed, so it gets an ordinary error
+		// response rather than the panic path used for unexpected errors.
+		ErrorBusy string
+		logger    zerver.Logger
 	}
 
+	// IDStore tracks in-flight and completed idempotency keys and lets the
+	// response of a completed request be replayed for later duplicates.
 	IDStore interface {
 		zerver.Component
-		// if ip-id pair already exist, return ErrRequestIDExist
-		Save(id string) error
-		Remove(id string) error
+
+		// Begin claims id for the current request, reserving it for at most
+		// ttl. If id is new, existed is false and the caller owns it until
+		// Complete/Fail is called. If id already exists, Begin waits for the
+		// owner to finish: completed is true and cachedResp holds the
+		// replayable response once it's ready, or completed is false if the
+		// owner is still working and the store gave up waiting. ctx carries
+		// the originating request's cancellation/deadline into the store.
+		Begin(ctx context.Context, id string, ttl time.Duration) (existed, completed bool, cachedResp []byte, err error)
+		// Complete stores the response produced for id so later duplicates
+		// can replay it, and releases anyone waiting in Begin.
+		Complete(ctx context.Context, id string, status int, header http.Header, body []byte) error
+		// Fail releases id without caching a response, allowing a later
+		// request with the same key to run as if it were the first.
+		Fail(ctx context.Context, id string) error
+	}
+
+	memEntry struct {
+		done     chan struct{}
+		closed   bool
+		resp     []byte
+		failed   bool
+		expireAt time.Time
 	}
 
 	MemIDStore struct {
-		requests map[string]struct{} // [ip:id]exist
+		// MaxInFlight caps the number of keys tracked at once, 0 means
+		// unbounded. New keys are rejected past the cap so an adversarial
+		// client can't grow the map without bound.
+		MaxInFlight int
+		// SweepInterval controls how often the janitor goroutine scans for
+		// expired entries, default defaultJanitorSweep.
+		SweepInterval time.Duration
+
+		requests map[string]*memEntry
 		lock     sync.RWMutex
+		stop     chan struct{}
 	}
 
-	// RedisIDStore depends on component.Redis
+	// RedisIDStore depends on component.RedisV8. The component can be
+	// configured for standalone, Sentinel or Cluster topologies; RedisIDStore
+	// only ever talks to the resulting redis.UniversalClient.
 	RedisIDStore struct {
-		Key   string // key for redis set to store ip-id pair, default use "RequestID"
-		redis *component.Redis
+		Key          string // key prefix for redis entries, default use "RequestID"
+		WaitTimeout  time.Duration
+		PollInterval time.Duration
+		client       goredis.UniversalClient
+	}
+
+	// cachedResponse is the serialized form of a completed request's
+	// response, as stored by IDStore.Complete and replayed from the
+	// cachedResp returned by IDStore.Begin.
+	cachedResponse struct {
+		Status int
+		Header http.Header
+		Body   []byte
+	}
+
+	// ShardedIDStore spreads ids across several child IDStores, typically
+	// RedisIDStore instances pointed at different Redis backends, so a
+	// single backend doesn't become a bottleneck under heavy write volume.
+	// Each id is routed by rendezvous (highest-random-weight) hashing, which
+	// only remaps ~1/N keys when a shard is added or removed.
+	ShardedIDStore struct {
+		Shards []IDStore
+		// ShardNames optionally names each shard for hashing purposes, so
+		// shards keep their identity if Shards is reordered. Defaults to the
+		// shard's index.
+		ShardNames []string
+		// ReplicaCount is how many shards each id is written to. A write
+		// only succeeds if a majority of its replicas agree, and a transient
+		// error talking to a shard falls through to the next-highest ranked
+		// one. Defaults to 1 (no replication).
+		ReplicaCount int
+
+		// reservedOn records, per id, exactly which shards a winning Begin
+		// actually reserved on. Begin's transient-error fallback means that
+		// set can differ from the statically ranked top-ReplicaCount shards,
+		// so Complete/Fail must replay it rather than recompute it.
+		reservedOn   map[string][]int
+		reservedLock sync.Mutex
 	}
 )
 
+func encodeCachedResponse(c cachedResponse) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeCachedResponse(data []byte) (cachedResponse, error) {
+	var c cachedResponse
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&c)
+	return c, err
+}
+
+func replayCachedResponse(resp zerver.Response, data []byte) error {
+	c, err := decodeCachedResponse(data)
+	if err != nil {
+		return err
+	}
+	header := resp.Header()
+	for name, values := range c.Header {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	resp.WriteHeader(c.Status)
+	_, err = resp.Write(c.Body)
+	return err
+}
+
+// teeResponse wraps a zerver.Response and captures everything written to it
+// so the response can be stored and replayed for a later duplicate request.
+type teeResponse struct {
+	zerver.Response
+	status int
+	body   bytes.Buffer
+}
+
+func newTeeResponse(resp zerver.Response) *teeResponse {
+	return &teeResponse{Response: resp, status: http.StatusOK}
+}
+
+func (t *teeResponse) WriteHeader(status int) {
+	t.status = status
+	t.Response.WriteHeader(status)
+}
+
+func (t *teeResponse) Write(data []byte) (int, error) {
+	t.body.Write(data)
+	return t.Response.Write(data)
+}
+
+// requestLogger wraps a zerver.Logger so every line Filter itself logs for a
+// request is prefixed with that request's id, the same correlation a
+// client-provided Idempotency-Key gets for free by appearing in the access
+// log, extended to ids this filter minted itself.
+type requestLogger struct {
+	zerver.Logger
+	id string
+}
+
+func (l requestLogger) Panicln(v ...interface{}) {
+	l.Logger.Panicln(append([]interface{}{l.id}, v...)...)
+}
+
+func (l requestLogger) Errorln(v ...interface{}) {
+	l.Logger.Errorln(append([]interface{}{l.id}, v...)...)
+}
+
 func (m *MemIDStore) Init(zerver.Enviroment) error {
-	m.requests = make(map[string]struct{})
-	m.lock = sync.RWMutex{}
+	m.requests = make(map[string]*memEntry)
+	m.stop = make(chan struct{})
+	if m.SweepInterval <= 0 {
+		m.SweepInterval = defaultJanitorSweep
+	}
+	go m.janitor()
 	return nil
 }
 
 func (m *MemIDStore) Destroy() {
+	close(m.stop)
 	m.requests = nil
 }
 
-func (m *MemIDStore) Save(id string) (err error) {
+// janitor periodically releases entries whose reservation outlived its TTL,
+// so a crash between Begin and Complete/Fail can't block a key forever.
+func (m *MemIDStore) janitor() {
+	ticker := time.NewTicker(m.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.sweep()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *MemIDStore) sweep() {
+	now := time.Now()
+
 	m.lock.Lock()
-	if _, has := m.requests[id]; has {
-		err = ErrRequestIDExist
-	} else {
-		m.requests[id] = struct{}{}
+	for id, entry := range m.requests {
+		if now.After(entry.expireAt) {
+			delete(m.requests, id)
+			m.closeEntry(entry, true)
+		}
+	}
+	m.lock.Unlock()
+}
+
+// closeEntry releases anyone waiting on entry.done. Must be called with
+// m.lock held, and is safe to call more than once for the same entry.
+func (m *MemIDStore) closeEntry(entry *memEntry, failed bool) {
+	if entry.closed {
+		return
+	}
+	entry.closed = true
+	entry.failed = failed
+	close(entry.done)
+}
+
+func (m *MemIDStore) Begin(ctx context.Context, id string, ttl time.Duration) (existed, completed bool, cachedResp []byte, err error) {
+	m.lock.Lock()
+	entry, has := m.requests[id]
+	if has && time.Now().After(entry.expireAt) {
+		delete(m.requests, id)
+		// Release anyone already blocked on <-entry.done: once the map
+		// entry is gone, neither Complete/Fail nor the janitor can ever
+		// reach this object again to close its channel for them.
+		m.closeEntry(entry, true)
+		has = false
+	}
+	if !has {
+		if m.MaxInFlight > 0 && len(m.requests) >= m.MaxInFlight {
+			m.lock.Unlock()
+			return false, false, nil, ErrTooManyInFlight
+		}
+		m.requests[id] = &memEntry{done: make(chan struct{}), expireAt: time.Now().Add(ttl)}
+		m.lock.Unlock()
+		return false, false, nil, nil
+	}
+	m.lock.Unlock()
 
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return true, false, nil, ctx.Err()
+	}
+	if entry.failed {
+		return m.Begin(ctx, id, ttl)
+	}
+	return true, true, entry.resp, nil
+}
+
+func (m *MemIDStore) Complete(ctx context.Context, id string, status int, header http.Header, body []byte) error {
+	data, err := encodeCachedResponse(cachedResponse{Status: status, Header: header, Body: body})
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	entry, has := m.requests[id]
+	if has {
+		entry.resp = data
+		m.closeEntry(entry, false)
 	}
 	m.lock.Unlock()
-	return
+	if !has {
+		return errors.Err("request id not found")
+	}
+	return nil
 }
 
-func (m *MemIDStore) Remove(id string) error {
+func (m *MemIDStore) Fail(ctx context.Context, id string) error {
 	m.lock.Lock()
-	delete(m.requests, id)
+	entry, has := m.requests[id]
+	if has {
+		delete(m.requests, id)
+		m.closeEntry(entry, true)
+	}
 	m.lock.Unlock()
 	return nil
 }
 
 func (r *RedisIDStore) Init(env zerver.Enviroment) error {
-	redis, err := env.Component(component.COMP_REDIS)
+	comp, err := env.Component(component.COMP_REDIS_V8)
 	if err == nil {
-		if redis == nil {
+		if comp == nil {
 			err = errors.Err("component redis isn't loaded")
 		} else {
-			r.redis = redis.(*component.Redis)
+			r.client = comp.(*component.RedisV8).Client()
 			defval.String(&r.Key, "RequestID")
+			if r.WaitTimeout <= 0 {
+				r.WaitTimeout = 5 * time.Second
+			}
+			if r.PollInterval <= 0 {
+				r.PollInterval = 50 * time.Millisecond
+			}
 		}
 	}
 	return err
 }
 
 func (r *RedisIDStore) Destroy() {
-	r.redis = nil
+	r.client = nil
 }
 
-func (r *RedisIDStore) Save(id string) error {
-	success, err := redis.Bool(r.redis.Exec("SADD", r.Key, id))
-	if err == nil && !success {
-		err = ErrRequestIDExist
+func (r *RedisIDStore) key(id string) string {
+	return r.Key + ":" + id
+}
+
+func (r *RedisIDStore) Begin(ctx context.Context, id string, ttl time.Duration) (existed, completed bool, cachedResp []byte, err error) {
+	key := r.key(id)
+	deadline := time.Now().Add(r.WaitTimeout)
+	for {
+		data, getErr := r.client.Get(ctx, key).Bytes()
+		switch {
+		case getErr == goredis.Nil:
+			// SetNX with an expiration makes the reservation and its
+			// expiration atomic, so a crash right after this call still
+			// expires the key.
+			ok, setErr := r.client.SetNX(ctx, key, "", ttl).Result()
+			if setErr != nil {
+				return false, false, nil, setErr
+			}
+			if ok {
+				return false, false, nil, nil
+			}
+			// lost the race to another request, fall through and poll it
+		case getErr != nil:
+			return false, false, nil, getErr
+		case len(data) > 0:
+			return true, true, data, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return true, false, nil, nil
+		}
+		select {
+		case <-ctx.Done():
+			return true, false, nil, ctx.Err()
+		case <-time.After(r.PollInterval):
+		}
 	}
-	return err
 }
 
-func (r *RedisIDStore) Remove(ip, id string) error {
-	_, err := r.redis.Exec("SREM", r.Key, id)
-	return err
+func (r *RedisIDStore) Complete(ctx context.Context, id string, status int, header http.Header, body []byte) error {
+	data, err := encodeCachedResponse(cachedResponse{Status: status, Header: header, Body: body})
+	if err != nil {
+		return err
+	}
+	key := r.key(id)
+	ttl, err := r.client.TTL(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		// The reservation already expired (or was never ours): writing the
+		// cached response now would use KeepTTL against a nonexistent key,
+		// which sets no expiration at all and leaks a permanent key. Nothing
+		// can still be waiting on an expired reservation, so there's
+		// nothing to do.
+		return nil
+	}
+	// KeepTTL preserves the expiration set by the SetNX reservation instead
+	// of making the cached response live forever.
+	return r.client.Set(ctx, key, data, goredis.KeepTTL).Err()
+}
+
+func (r *RedisIDStore) Fail(ctx context.Context, id string) error {
+	return r.client.Del(ctx, r.key(id)).Err()
+}
+
+func (s *ShardedIDStore) Init(env zerver.Enviroment) error {
+	if len(s.Shards) == 0 {
+		return errors.Err("ShardedIDStore needs at least one shard")
+	}
+	if s.ReplicaCount < 1 {
+		s.ReplicaCount = 1
+	}
+	s.reservedOn = make(map[string][]int)
+	for _, shard := range s.Shards {
+		if err := shard.Init(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedIDStore) Destroy() {
+	for _, shard := range s.Shards {
+		shard.Destroy()
+	}
+}
+
+func (s *ShardedIDStore) shardName(i int) string {
+	if i < len(s.ShardNames) {
+		return s.ShardNames[i]
+	}
+	return strconv.Itoa(i)
+}
+
+// rankShards orders shard indexes by rendezvous weight for id, highest first.
+func (s *ShardedIDStore) rankShards(id string) []int {
+	type weighted struct {
+		index  int
+		weight uint64
+	}
+	weights := make([]weighted, len(s.Shards))
+	for i := range s.Shards {
+		weights[i] = weighted{i, xxhash.Sum64String(s.shardName(i) + id)}
+	}
+	sort.Slice(weights, func(a, b int) bool { return weights[a].weight > weights[b].weight })
+
+	indexes := make([]int, len(weights))
+	for i, w := range weights {
+		indexes[i] = w.index
+	}
+	return indexes
+}
+
+// replicaIndexes returns the statically ranked top ReplicaCount shard indexes
+// for id. shardsFor falls back to it when Begin recorded no reservation for
+// id; Begin itself may reserve on a different set, see reservedOn.
+func (s *ShardedIDStore) replicaIndexes(id string) []int {
+	ranked := s.rankShards(id)
+	n := s.ReplicaCount
+	if n > len(ranked) {
+		n = len(ranked)
+	}
+	return ranked[:n]
+}
+
+func (s *ShardedIDStore) Begin(ctx context.Context, id string, ttl time.Duration) (existed, completed bool, cachedResp []byte, err error) {
+	ranked := s.rankShards(id)
+	replicaCount := s.ReplicaCount
+	if replicaCount > len(ranked) {
+		replicaCount = len(ranked)
+	}
+	quorum := replicaCount/2 + 1
+
+	var fresh, answered int
+	var reservedOn []int
+	for _, idx := range ranked {
+		shardExisted, shardCompleted, shardResp, shardErr := s.Shards[idx].Begin(ctx, id, ttl)
+		if shardErr != nil {
+			// transient error talking to this shard, fall through to the
+			// next-ranked shard instead of failing the whole write
+			continue
+		}
+		answered++
+		switch {
+		case shardCompleted:
+			// A single completed answer is decisive by itself: the Begin
+			// that reserved this key may have fallen through past transient
+			// errors to land on shards ranked below this one, so a prior
+			// completed write can surface here even after a full batch of
+			// fresh answers has already been tallied above it in rank
+			// order. Stopping the scan at the first ReplicaCount answers
+			// (mixing fresh and done together) risks never reaching it and
+			// double-executing the handler, so every ranked shard is
+			// consulted before a fresh quorum is trusted.
+			return true, true, shardResp, nil
+		case !shardExisted:
+			if len(reservedOn) < replicaCount {
+				fresh++
+				reservedOn = append(reservedOn, idx)
+			} else {
+				// Already hold enough fresh reservations; this shard was
+				// only queried to rule out a completed answer further down
+				// the ranking and got reserved as a side effect of that
+				// probe. Release it immediately instead of leaving a
+				// spurious reservation sitting until ttl.
+				_ = s.Shards[idx].Fail(ctx, id)
+			}
+			// existed but not completed: in-flight on another shard, counts
+			// towards neither fresh nor done.
+		}
+	}
+
+	if answered == 0 {
+		return false, false, nil, errors.Err("no shard available to serve request id")
+	}
+	if fresh >= quorum {
+		// Remember exactly which shards this Begin reserved on: the
+		// fallback above means it isn't necessarily the statically ranked
+		// top-ReplicaCount set, and Complete/Fail must write to the same
+		// shards the reservation actually lives on.
+		s.reservedLock.Lock()
+		s.reservedOn[id] = reservedOn
+		s.reservedLock.Unlock()
+		return false, false, nil, nil
+	}
+	return true, false, nil, nil
+}
+
+// shardsFor returns the shards a winning Begin actually reserved id on, or
+// falls back to the statically ranked top-ReplicaCount set if Begin's
+// bookkeeping for id is unavailable (e.g. after a restart).
+func (s *ShardedIDStore) shardsFor(id string) []int {
+	s.reservedLock.Lock()
+	idxs, ok := s.reservedOn[id]
+	s.reservedLock.Unlock()
+	if ok {
+		return idxs
+	}
+	return s.replicaIndexes(id)
+}
+
+func (s *ShardedIDStore) Complete(ctx context.Context, id string, status int, header http.Header, body []byte) error {
+	var firstErr error
+	for _, idx := range s.shardsFor(id) {
+		if err := s.Shards[idx].Complete(ctx, id, status, header, body); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.forgetReservation(id)
+	return firstErr
+}
+
+func (s *ShardedIDStore) Fail(ctx context.Context, id string) error {
+	var firstErr error
+	for _, idx := range s.shardsFor(id) {
+		if err := s.Shards[idx].Fail(ctx, id); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.forgetReservation(id)
+	return firstErr
+}
+
+// forgetReservation drops the bookkeeping Begin recorded for id once its
+// owner has called Complete or Fail, so reservedOn doesn't grow unbounded.
+func (s *ShardedIDStore) forgetReservation(id string) {
+	s.reservedLock.Lock()
+	delete(s.reservedOn, id)
+	s.reservedLock.Unlock()
+}
+
+// uuidv4 returns a random RFC 4122 version 4 UUID, used as the default
+// IDGenerator.
+func uuidv4() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
 }
 
 func (ri *RequestId) Init(env zerver.Enviroment) error {
 	defval.Nil(&ri.Store, new(MemIDStore))
-	ri.Store.Init(env)
-	defval.String(&ri.HeaderName, "X-Request-Id")
-	defval.String(&ri.Error, "header value X-Request-Id can't be empty")
+	defval.String(&ri.HeaderName, "Idempotency-Key")
+	defval.String(&ri.Error, "header value Idempotency-Key can't be empty")
 	defval.String(&ri.ErrorOverlap, "request already accepted before, please wait")
+	defval.String(&ri.ErrorBusy, "server is handling too many requests, please retry later")
+	defval.String(&ri.ResponseHeaderName, "X-Request-Id")
+	defval.Nil(&ri.IDGenerator, IDGenerator(uuidv4))
+	if ri.TTL <= 0 {
+		ri.TTL = time.Minute
+	}
+	// MemIDStore has no TTL of its own to sweep by. Left at its standalone
+	// default, an entry can sit expired-but-unswept for up to
+	// defaultJanitorSweep regardless of how short TTL is configured here,
+	// during which it still counts against MaxInFlight and can reject
+	// traffic for keys that are logically already dead. Bias the janitor to
+	// TTL/2 instead, unless the caller set SweepInterval explicitly.
+	if mem, ok := ri.Store.(*MemIDStore); ok && mem.SweepInterval <= 0 {
+		mem.SweepInterval = ri.TTL / 2
+	}
+	ri.Store.Init(env)
 	ri.logger = env.Logger()
 	return nil
 }
@@ -120,6 +641,11 @@ func (ri *RequestId) Filter(req zerver.Request, resp zerver.Response, chain zerv
 		return
 	}
 	reqId := req.Header(ri.HeaderName)
+	generated := false
+	if reqId == "" && ri.GenerateIfMissing {
+		reqId = ri.IDGenerator()
+		generated = true
+	}
 	if reqId == "" {
 		if ri.PassingOnNoId {
 			chain(req, resp)
@@ -127,18 +653,70 @@ func (ri *RequestId) Filter(req zerver.Request, resp zerver.Response, chain zerv
 			resp.ReportBadRequest()
 			resp.Send("error", ri.Error)
 		}
-	} else {
-		id := req.RemoteIP() + ":" + reqId
-		if err := ri.Store.Save(id); err == ErrRequestIDExist {
+		return
+	}
+	req.SetAttr(AttrRequestID, reqId)
+	if generated {
+		resp.Header().Set(ri.ResponseHeaderName, reqId)
+	}
+	logger := requestLogger{Logger: ri.logger, id: reqId}
+
+	// A generated id runs through Store exactly like a client-provided one:
+	// it's unique by construction, so it only ever takes the fresh branch
+	// below, but that still buys it the same crash-safety (Fail on panic)
+	// and TTL-bounded reservation as any other request, instead of a silent
+	// exception to the rest of this filter.
+	ctx := req.Context()
+	id := req.RemoteIP() + ":" + reqId
+	existed, completed, cachedResp, err := ri.Store.Begin(ctx, id, ri.TTL)
+	if err == ErrTooManyInFlight {
+		resp.ReportServiceUnavailable()
+		resp.Send("error", ri.ErrorBusy)
+		return
+	} else if err != nil {
+		logger.Panicln(err)
+		return
+	}
+	if existed {
+		if completed {
+			if err := replayCachedResponse(resp, cachedResp); err != nil {
+				logger.Panicln(err)
+			}
+		} else {
 			resp.ReportForbidden()
 			resp.Send("error", ri.ErrorOverlap)
-		} else if err != nil {
-			ri.logger.Panicln(err)
-		} else {
-			chain(req, resp)
-			ri.Store.Remove(id)
 		}
+		return
 	}
+
+	tee := newTeeResponse(resp)
+	ri.runChain(ctx, id, req, tee, chain, logger)
+
+	// By now the response has already been written through tee to the real
+	// resp, so a Complete error (e.g. the reservation already expired out
+	// from under a slow handler) can't be kept from reaching the client,
+	// and panicking buys nothing but crashing the server on an otherwise
+	// harmless race; log it instead.
+	if err := ri.Store.Complete(ctx, id, tee.status, tee.Header(), tee.body.Bytes()); err != nil {
+		logger.Errorln(err)
+	}
+}
+
+// runChain runs chain, releasing the Store reservation for id via Fail if
+// the handler panics instead of returning normally. Without this, a panic
+// (or any abandoned request that never reaches Complete) leaves the key
+// reserved until TTL expires, and every legitimate retry with the same
+// Idempotency-Key gets a spurious overlap error in the meantime.
+func (ri *RequestId) runChain(ctx context.Context, id string, req zerver.Request, resp zerver.Response, chain zerver.FilterChain, logger zerver.Logger) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if err := ri.Store.Fail(ctx, id); err != nil {
+				logger.Errorln(err)
+			}
+			panic(rec)
+		}
+	}()
+	chain(req, resp)
 }
 
-func (ri *RequestId) Destroy() {}
\ No newline at end of file
+func (ri *RequestId) Destroy() {}
@@ -0,0 +1,236 @@
+package filter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/errors"
+	"github.com/cosiner/zerver"
+)
+
+// fakeRequest is a minimal zerver.Request standing in for tests: it embeds
+// the interface so any method the code under test doesn't exercise still
+// satisfies it, mirroring teeResponse's embedding of zerver.Response.
+type fakeRequest struct {
+	zerver.Request
+	method  string
+	headers map[string]string
+}
+
+func (r *fakeRequest) Method() string            { return r.method }
+func (r *fakeRequest) Header(name string) string { return r.headers[name] }
+func (r *fakeRequest) RemoteIP() string          { return "127.0.0.1" }
+func (r *fakeRequest) Context() context.Context  { return context.Background() }
+func (r *fakeRequest) SetAttr(key, value string) {}
+
+type fakeResponse struct {
+	zerver.Response
+	status int
+}
+
+func (r *fakeResponse) Header() http.Header                { return make(http.Header) }
+func (r *fakeResponse) WriteHeader(status int)             { r.status = status }
+func (r *fakeResponse) Write(p []byte) (int, error)        { return len(p), nil }
+func (r *fakeResponse) ReportBadRequest()                  { r.status = 400 }
+func (r *fakeResponse) ReportForbidden()                   { r.status = 403 }
+func (r *fakeResponse) ReportServiceUnavailable()          { r.status = 503 }
+func (r *fakeResponse) Send(key string, value interface{}) {}
+
+// fakeLogger only implements the methods RequestId actually calls; anything
+// else falls through to the embedded nil zerver.Logger, same pattern as
+// fakeRequest/fakeResponse above.
+type fakeLogger struct {
+	zerver.Logger
+}
+
+func (l *fakeLogger) Panicln(v ...interface{}) { panic(v) }
+func (l *fakeLogger) Errorln(v ...interface{}) {}
+
+type fakeEnv struct {
+	zerver.Enviroment
+	logger zerver.Logger
+}
+
+func (e *fakeEnv) Logger() zerver.Logger { return e.logger }
+
+// TestRequestIdPanicReleasesReservation checks that a handler panic doesn't
+// leave a key's reservation stuck until TTL: a second request with the same
+// Idempotency-Key must be allowed to run right away instead of getting a
+// spurious overlap error.
+func TestRequestIdPanicReleasesReservation(t *testing.T) {
+	store := &MemIDStore{}
+	ri := &RequestId{Store: store, TTL: time.Minute}
+	if err := ri.Init(&fakeEnv{logger: &fakeLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+
+	panicking := zerver.FilterChain(func(zerver.Request, zerver.Response) {
+		panic("boom")
+	})
+	func() {
+		defer func() { recover() }()
+		req := &fakeRequest{method: "POST", headers: map[string]string{ri.HeaderName: "key-1"}}
+		ri.Filter(req, &fakeResponse{}, panicking)
+	}()
+
+	ran := false
+	noop := zerver.FilterChain(func(zerver.Request, zerver.Response) { ran = true })
+	req2 := &fakeRequest{method: "POST", headers: map[string]string{ri.HeaderName: "key-1"}}
+	ri.Filter(req2, &fakeResponse{}, noop)
+	if !ran {
+		t.Fatal("second request with the same key was rejected; the panicked handler's reservation was not released")
+	}
+}
+
+// TestMemIDStoreConcurrentBeginDedup checks that of many concurrent Begin
+// calls for the same id, exactly one is treated as fresh and the rest wait
+// for and replay its completed response.
+func TestMemIDStoreConcurrentBeginDedup(t *testing.T) {
+	store := &MemIDStore{}
+	if err := store.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+
+	const n = 20
+	var freshCount int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			existed, completed, _, err := store.Begin(context.Background(), "dup", time.Minute)
+			if err != nil {
+				t.Errorf("Begin: %v", err)
+				return
+			}
+			if !existed {
+				atomic.AddInt32(&freshCount, 1)
+				time.Sleep(10 * time.Millisecond)
+				if err := store.Complete(context.Background(), "dup", 200, nil, []byte("ok")); err != nil {
+					t.Errorf("Complete: %v", err)
+				}
+			} else if !completed {
+				t.Errorf("waiter returned before the owner completed")
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if freshCount != 1 {
+		t.Fatalf("want exactly 1 fresh Begin among %d concurrent callers, got %d", n, freshCount)
+	}
+}
+
+// TestMemIDStoreTTLExpiryReleasesWaiters checks that a request blocked in
+// Begin behind an owner who never calls Complete/Fail (a crashed handler) is
+// released once the owner's reservation outlives its TTL, instead of
+// hanging until its own unrelated context deadline.
+func TestMemIDStoreTTLExpiryReleasesWaiters(t *testing.T) {
+	store := &MemIDStore{SweepInterval: 10 * time.Millisecond}
+	if err := store.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+
+	ctx := context.Background()
+	existed, _, _, err := store.Begin(ctx, "stuck", 20*time.Millisecond)
+	if err != nil || existed {
+		t.Fatalf("want a fresh owner, got existed=%v err=%v", existed, err)
+	}
+	// The owner never calls Complete or Fail, simulating a crashed handler.
+
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		existed, _, _, err := store.Begin(ctx, "stuck", time.Minute)
+		if err != nil {
+			t.Errorf("waiter Begin: %v", err)
+			return
+		}
+		if existed {
+			t.Errorf("waiter should see the key as released after ttl expiry, not existed")
+		}
+	}()
+
+	select {
+	case <-waiterDone:
+	case <-time.After(time.Second):
+		t.Fatal("waiter was never released after the reservation's ttl expired")
+	}
+}
+
+// flakyShard wraps an IDStore and fails the first failBeginTimes calls to
+// Begin with a transient error, simulating the kind of backend hiccup
+// ShardedIDStore.Begin falls through to the next-ranked shard for.
+type flakyShard struct {
+	IDStore
+	mu             sync.Mutex
+	failBeginTimes int
+}
+
+func (f *flakyShard) Begin(ctx context.Context, id string, ttl time.Duration) (bool, bool, []byte, error) {
+	f.mu.Lock()
+	if f.failBeginTimes > 0 {
+		f.failBeginTimes--
+		f.mu.Unlock()
+		return false, false, nil, errors.Err("transient shard error")
+	}
+	f.mu.Unlock()
+	return f.IDStore.Begin(ctx, id, ttl)
+}
+
+// TestShardedIDStoreQuorumSurvivesFallback exercises the scenario where a
+// Begin's transient-error fallback lands a reservation (and later its
+// completed response) on shards other than the statically ranked
+// top-ReplicaCount set. A later Begin for the same key, issued once the
+// flaky shard has recovered, must still discover the completed response
+// instead of authorizing a second execution of the handler.
+func TestShardedIDStoreQuorumSurvivesFallback(t *testing.T) {
+	shardA := &flakyShard{IDStore: &MemIDStore{}, failBeginTimes: 1}
+	shardB := &MemIDStore{}
+	shardC := &MemIDStore{}
+
+	s := &ShardedIDStore{
+		Shards:       []IDStore{shardA, shardB, shardC},
+		ShardNames:   []string{"a", "b", "c"},
+		ReplicaCount: 2,
+	}
+	if err := s.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy()
+
+	ctx := context.Background()
+	const id = "k1"
+
+	existed, completed, _, err := s.Begin(ctx, id, time.Minute)
+	if err != nil || existed {
+		t.Fatalf("first Begin: existed=%v completed=%v err=%v", existed, completed, err)
+	}
+	if err := s.Complete(ctx, id, 200, nil, []byte("done")); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	// Retry now that the flaky shard's scripted error has been spent: a
+	// correct quorum check must find the completed response regardless of
+	// which shards it actually landed on.
+	existed2, completed2, resp2, err := s.Begin(ctx, id, time.Minute)
+	if err != nil {
+		t.Fatalf("second Begin: %v", err)
+	}
+	if !existed2 || !completed2 {
+		t.Fatalf("second Begin for the same key should replay the cached response, got existed=%v completed=%v (double-execution risk)", existed2, completed2)
+	}
+	if len(resp2) == 0 {
+		t.Fatalf("expected a cached response to replay")
+	}
+}